@@ -21,9 +21,9 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"crypto/sha256"
 	"flag"
-	"go/build"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -33,28 +33,41 @@ import (
 	"sort"
 	"strings"
 	"text/template"
+
+	"golang.org/x/tools/go/packages"
+	"gopkg.in/yaml.v3"
 )
 
 var (
-	baseFlag = flag.String("base", ".", "base directory of the repo, relative to the working directory")
-	outFlag  = flag.String("o", "Dockerfile-testing", "output file, relative to this directory")
-	diffFlag = flag.Bool("d", false, "diff file against output file instead of writing")
+	baseFlag   = flag.String("base", ".", "base directory of the repo, relative to the working directory")
+	outFlag    = flag.String("o", "Dockerfile-testing", "output file, relative to this directory")
+	diffFlag   = flag.Bool("d", false, "diff file against output file instead of writing")
+	checkFlag  = flag.Bool("check", false, "check that the output file is up to date with go.mod/go.sum, without writing it")
+	matrixFlag = flag.String("matrix", "", "path to a build-matrix config (YAML); generates one Dockerfile per Go version/module cell instead of the single top-level Dockerfile")
 )
 
-// This generates a Dockerfile that explicitly runs "go get" for each
-// external import.
-var dockerfileTemplate = template.Must(template.New("Dockerfile").Parse(`
+// This generates a Dockerfile that builds and tests the module in-place,
+// using "go mod download" to fetch dependencies into their own Docker
+// layer so that a change to the source tree doesn't bust the dependency
+// cache. The go.sum hash is stamped into a comment so that -check can
+// detect a dependency bump even though it changes nothing else about
+// the rendered Dockerfile.
+var gomodDockerfileTemplate = template.Must(template.New("Dockerfile").Parse(`
 # Code generated by gendockerfile. DO NOT EDIT.
+# go.sum: {{.GoSumHash}}
 FROM golang:latest
-WORKDIR /go/src/go.elastic.co/apm
-{{range .Imports}}RUN go get -v {{.}}
-{{end}}
-ADD . /go/src/go.elastic.co/apm
+WORKDIR /src
+COPY go.mod go.sum ./
+RUN go mod download
+COPY . .
+RUN go build {{.BuildFlags}} ./...
+RUN go test {{.BuildFlags}} ./...
 `[1:]))
 
-// isExternal reports whether or not importPath refers to
-// an external import: one outside of the standard library
-// or the vendor directory.
+// isExternal reports whether or not importPath refers to an external
+// import: one outside of the standard library or the vendor directory.
+// It is a GOPATH-era heuristic, used only as a fallback for repos with
+// no module metadata for loadExternalImports to compare against.
 func isExternal(importPath string) bool {
 	r := strings.IndexRune(importPath, '/')
 	if r == -1 {
@@ -63,77 +76,344 @@ func isExternal(importPath string) bool {
 	return strings.IndexRune(importPath[:r], '.') != -1
 }
 
-func relPath(p string) string {
-	if *baseFlag == "." {
-		return "./" + p
+// This generates a Dockerfile that explicitly runs "go get" for each
+// external import. It is retained for GOPATH-mode repos that have not
+// yet migrated to Go modules.
+var gopathDockerfileTemplate = template.Must(template.New("Dockerfile").Parse(`
+# Code generated by gendockerfile. DO NOT EDIT.
+FROM golang:latest
+WORKDIR /go/src/go.elastic.co/apm
+{{range .Imports}}RUN go get -v {{.}}
+{{end}}
+ADD . /go/src/go.elastic.co/apm
+`[1:]))
+
+// This generates a Dockerfile scoped to a single module subdirectory
+// (e.g. module/gin), built and tested against one specific Go version.
+// Like gomodDockerfileTemplate, it stamps the module's go.sum hash into
+// a comment so that -check can detect a dependency bump inside this
+// submodule.
+var matrixDockerfileTemplate = template.Must(template.New("Dockerfile").Parse(`
+# Code generated by gendockerfile. DO NOT EDIT.
+# go.sum: {{.GoSumHash}}
+FROM golang:{{.GoVersion}}
+WORKDIR /src/{{.ModulePath}}
+COPY {{.ModulePath}}/go.mod {{.ModulePath}}/go.sum ./
+RUN go mod download
+COPY {{.ModulePath}}/ .
+RUN go build {{.BuildFlags}} ./...
+RUN go test {{.BuildFlags}} ./...
+`[1:]))
+
+var composeTemplate = template.Must(template.New("docker-compose.yml").Parse(`
+# Code generated by gendockerfile. DO NOT EDIT.
+version: "3"
+services:
+{{range .Cells}}  {{.Service}}:
+    build:
+      context: ..
+      dockerfile: scripts/{{.Dockerfile}}
+{{end}}`[1:]))
+
+// matrixConfig describes the cross product of Go versions and module
+// subdirectories that -matrix generates a Dockerfile for.
+type matrixConfig struct {
+	GoVersions []string `yaml:"go_versions"`
+	Modules    []string `yaml:"modules"`
+}
+
+func loadMatrixConfig(configPath string) (*matrixConfig, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var cfg matrixConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", configPath, err)
+	}
+	if len(cfg.GoVersions) == 0 {
+		return nil, fmt.Errorf("%s: go_versions must not be empty", configPath)
+	}
+	if len(cfg.Modules) == 0 {
+		return nil, fmt.Errorf("%s: modules must not be empty", configPath)
 	}
-	return path.Join(*baseFlag, p)
+	return &cfg, nil
 }
 
-func main() {
-	flag.Parse()
-	cmd := exec.Command("go", "list", "-json", relPath("..."), relPath("vendor/..."))
-	cmd.Stderr = os.Stderr
-	stdout, err := cmd.StdoutPipe()
+// matrixCellName returns the Dockerfile name for one (goVersion, module)
+// cell of the build matrix, e.g. Dockerfile-testing-1.21-gin.
+func matrixCellName(goVersion, modulePath string) string {
+	return fmt.Sprintf("Dockerfile-testing-%s-%s", goVersion, strings.ReplaceAll(modulePath, "/", "-"))
+}
+
+func writeMatrixDockerfile(out io.Writer, goVersion, modulePath string) error {
+	modDir := filepath.Join(*baseFlag, "module", modulePath)
+	if _, err := os.Stat(filepath.Join(modDir, "go.mod")); err != nil {
+		return fmt.Errorf("module/%s: %w", modulePath, err)
+	}
+	goSum, err := os.ReadFile(filepath.Join(modDir, "go.sum"))
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("module/%s: go.mod present without go.sum: %w", modulePath, err)
 	}
-	if err := cmd.Start(); err != nil {
-		log.Fatal(err)
+	// Validate this module alone, scoped away from the rest of the
+	// matrix, so one integration with a broken build tag is reported
+	// without stopping runMatrix from generating the other cells.
+	if _, err := loadPackages(modDir, "./..."); err != nil {
+		return fmt.Errorf("module/%s: %w", modulePath, err)
 	}
 
-	externalImports := make(map[string]bool)
-	decoder := json.NewDecoder(stdout)
-	for {
-		var pkg build.Package
-		if err := decoder.Decode(&pkg); err != nil {
-			if err != io.EOF {
-				log.Fatal(err)
-			}
-			break
+	data := struct {
+		GoVersion  string
+		ModulePath string
+		BuildFlags string
+		GoSumHash  string
+	}{
+		GoVersion:  goVersion,
+		ModulePath: path.Join("module", modulePath),
+		BuildFlags: "-mod=readonly",
+		GoSumHash:  fmt.Sprintf("%x", sha256.Sum256(goSum)),
+	}
+	if hasVendorDir(modDir) {
+		data.BuildFlags = "-mod=vendor"
+	}
+	return matrixDockerfileTemplate.Execute(out, &data)
+}
+
+// writeCompose emits a docker-compose.yml with one service per matrix
+// cell, so CI can build and run the whole matrix with a single command
+// instead of one monolithic image covering every integration.
+func writeCompose(out io.Writer, cfg *matrixConfig) error {
+	type cell struct {
+		Service    string
+		Dockerfile string
+	}
+	data := struct{ Cells []cell }{}
+	for _, goVersion := range cfg.GoVersions {
+		for _, modulePath := range cfg.Modules {
+			dockerfile := matrixCellName(goVersion, modulePath)
+			data.Cells = append(data.Cells, cell{
+				Service:    strings.ToLower(strings.ReplaceAll(dockerfile[len("Dockerfile-testing-"):], ".", "-")),
+				Dockerfile: dockerfile,
+			})
 		}
-		externalImports[pkg.ImportPath] = false
-		imports := append(pkg.Imports, pkg.TestImports...)
-		imports = append(imports, pkg.XTestImports...)
-		for _, importPath := range imports {
-			if _, ok := externalImports[importPath]; ok {
+	}
+	return composeTemplate.Execute(out, &data)
+}
+
+// runMatrix generates one Dockerfile per (goVersion, module) cell plus a
+// docker-compose.yml that builds and runs all of them, publishing each
+// according to diffFlag/checkFlag/write semantics. A cell that fails to
+// generate (e.g. a broken build tag in one integration) is recorded and
+// skipped rather than aborting the rest of the matrix, including
+// docker-compose.yml generation.
+func runMatrix(cfg *matrixConfig) error {
+	var errs []string
+	for _, goVersion := range cfg.GoVersions {
+		for _, modulePath := range cfg.Modules {
+			var buf bytes.Buffer
+			if err := writeMatrixDockerfile(&buf, goVersion, modulePath); err != nil {
+				errs = append(errs, err.Error())
 				continue
 			}
-			externalImports[importPath] = isExternal(importPath)
+			outFile := filepath.Join(*baseFlag, "scripts", matrixCellName(goVersion, modulePath))
+			if err := publish(&buf, outFile); err != nil {
+				errs = append(errs, err.Error())
+			}
 		}
 	}
 
+	var buf bytes.Buffer
+	if err := writeCompose(&buf, cfg); err != nil {
+		return err
+	}
+	if err := publish(&buf, filepath.Join(*baseFlag, "scripts", "docker-compose.yml")); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("matrix generation had %d error(s):\n%s", len(errs), strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// hasGoMod reports whether base contains a go.mod file, i.e. whether
+// the repo at base is managed with Go modules rather than GOPATH.
+func hasGoMod(base string) bool {
+	_, err := os.Stat(filepath.Join(base, "go.mod"))
+	return err == nil
+}
+
+// hasVendorDir reports whether base contains a vendor directory.
+func hasVendorDir(base string) bool {
+	info, err := os.Stat(filepath.Join(base, "vendor"))
+	return err == nil && info.IsDir()
+}
+
+func writeGomodDockerfile(out io.Writer) error {
+	// go.sum pins every module in the build to an exact version and
+	// content hash, so "go mod download" on its own is byte-reproducible
+	// given the same repo state; without it there is nothing to pin to.
+	goSum, err := os.ReadFile(filepath.Join(*baseFlag, "go.sum"))
+	if err != nil {
+		return fmt.Errorf("go.mod present without go.sum: %w", err)
+	}
+
 	var data struct {
-		Imports []string
+		BuildFlags string
+		GoSumHash  string
+	}
+	data.GoSumHash = fmt.Sprintf("%x", sha256.Sum256(goSum))
+	if hasVendorDir(*baseFlag) {
+		data.BuildFlags = "-mod=vendor"
+	} else {
+		data.BuildFlags = "-mod=readonly"
+	}
+	return gomodDockerfileTemplate.Execute(out, &data)
+}
+
+// loadPackages loads the packages matching patterns, rooted at base,
+// including test and external test (xtest) variants, and returns a
+// non-nil error if any loaded package failed to build, e.g. because a
+// build-tag combination is broken.
+func loadPackages(base string, patterns ...string) ([]*packages.Package, error) {
+	cfg := &packages.Config{
+		Dir:   base,
+		Mode:  packages.NeedName | packages.NeedImports | packages.NeedDeps | packages.NeedModule,
+		Tests: true,
+	}
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, err
 	}
-	for importPath, isExternal := range externalImports {
-		if isExternal {
-			data.Imports = append(data.Imports, importPath)
+
+	var loadErrs []string
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		for _, e := range pkg.Errors {
+			loadErrs = append(loadErrs, e.Error())
 		}
+	})
+	if len(loadErrs) > 0 {
+		return nil, fmt.Errorf("errors loading packages:\n%s", strings.Join(loadErrs, "\n"))
 	}
-	sort.Strings(data.Imports)
+	return pkgs, nil
+}
 
-	var buf bytes.Buffer
-	var out io.Writer = &buf
-	outFile := filepath.Join(*baseFlag, "scripts", *outFlag)
-	if !*diffFlag {
-		f, err := os.Create(outFile)
-		if err != nil {
-			log.Fatal(err)
+// loadExternalImports returns the sorted, de-duplicated set of import
+// paths loaded from patterns, rooted at base, that are external to the
+// main tree. A dependency that is only ever imported by a _test.go file
+// is still reported, since loadPackages includes test and xtest
+// variants. When the loaded tree has module metadata, externality is
+// determined by comparing each package's owning module against the main
+// module; GOPATH-mode trees have no module metadata at all, so in that
+// case we fall back to the isExternal string heuristic for anything
+// that wasn't itself one of the requested root packages.
+func loadExternalImports(base string, patterns ...string) ([]string, error) {
+	pkgs, err := loadPackages(base, patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	var mainModule string
+	for _, pkg := range pkgs {
+		if pkg.Module != nil && pkg.Module.Main {
+			mainModule = pkg.Module.Path
+			break
 		}
-		defer f.Close()
-		out = f
 	}
-	if err := dockerfileTemplate.Execute(out, &data); err != nil {
-		log.Fatal(err)
+
+	rootPkgs := make(map[string]bool, len(pkgs))
+	for _, pkg := range pkgs {
+		rootPkgs[pkg.PkgPath] = true
+	}
+
+	external := make(map[string]bool)
+	packages.Visit(pkgs, func(pkg *packages.Package) bool {
+		switch {
+		case mainModule != "":
+			if pkg.Module != nil && pkg.Module.Path != mainModule {
+				external[pkg.PkgPath] = true
+			}
+		case !rootPkgs[pkg.PkgPath] && isExternal(pkg.PkgPath):
+			external[pkg.PkgPath] = true
+		}
+		return true
+	}, nil)
+
+	imports := make([]string, 0, len(external))
+	for importPath := range external {
+		imports = append(imports, importPath)
 	}
+	sort.Strings(imports)
+	return imports, nil
+}
+
+func writeGopathDockerfile(out io.Writer) error {
+	imports, err := loadExternalImports(*baseFlag, "./...")
+	if err != nil {
+		return err
+	}
+	data := struct{ Imports []string }{Imports: imports}
+	return gopathDockerfileTemplate.Execute(out, &data)
+}
+
+// publish writes buf to outFile, or, depending on diffFlag/checkFlag,
+// diffs it against the existing file or asserts that it is unchanged.
+func publish(buf *bytes.Buffer, outFile string) error {
 	if *diffFlag {
 		cmd := exec.Command("diff", "-c", outFile, "-")
-		cmd.Stdin = &buf
+		cmd.Stdin = bytes.NewReader(buf.Bytes())
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
+		return cmd.Run()
+	}
+
+	if *checkFlag {
+		existing, err := os.ReadFile(outFile)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(existing, buf.Bytes()) {
+			return fmt.Errorf("%s is out of date; regenerate it by running gendockerfile.go with the same flags, without -check", outFile)
+		}
+		return nil
+	}
+
+	f, err := os.Create(outFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, buf)
+	return err
+}
+
+func main() {
+	flag.Parse()
+
+	if *matrixFlag != "" {
+		cfg, err := loadMatrixConfig(*matrixFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := runMatrix(cfg); err != nil {
 			log.Fatal(err)
 		}
+		return
+	}
+
+	var buf bytes.Buffer
+	var err error
+	if hasGoMod(*baseFlag) {
+		err = writeGomodDockerfile(&buf)
+	} else {
+		err = writeGopathDockerfile(&buf)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	outFile := filepath.Join(*baseFlag, "scripts", *outFlag)
+	if err := publish(&buf, outFile); err != nil {
+		log.Fatal(err)
 	}
 }